@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSignVerifyTokenRoundTrip(t *testing.T) {
+	tok, err := signToken("secret", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel, err := verifyToken("secret", tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel != "acme" {
+		t.Fatalf("channel = %q, want acme", channel)
+	}
+
+	if _, err := verifyToken("wrong-secret", tok); err == nil {
+		t.Fatal("expected verification to fail with the wrong secret")
+	}
+}
+
+func TestVerifyTokenRejectsMalformedValue(t *testing.T) {
+	if _, err := verifyToken("secret", "not-a-token"); err == nil {
+		t.Fatal("expected a malformed token to be rejected")
+	}
+}
+
+func newTestServer() *server {
+	log := zerolog.New(io.Discard)
+	return &server{
+		authMode:   authModeSharedSecret,
+		authSecret: "secret",
+		replaySize: 8,
+		log:        &log,
+		channels:   make(map[string]*ring),
+		listeners:  make(map[string]map[string]struct{}),
+	}
+}
+
+func TestChannelsAreIsolated(t *testing.T) {
+	s := newTestServer()
+
+	s.channelRing("acme").push("hello-acme")
+	s.channelRing("globex").push("hello-globex")
+
+	msg, _, _, _, ok := s.channelRing("acme").pull(0)
+	if !ok || msg != "hello-acme" {
+		t.Fatalf("channel acme got %q, %v", msg, ok)
+	}
+
+	msg, _, _, _, ok = s.channelRing("globex").pull(0)
+	if !ok || msg != "hello-globex" {
+		t.Fatalf("channel globex got %q, %v", msg, ok)
+	}
+}
+
+func TestSharedSecretListenerCannotJoinAnotherChannel(t *testing.T) {
+	s := newTestServer()
+
+	id, err := s.newListenerID("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addListener("acme", id)
+
+	if _, ok := s.verifyListener("acme", id); !ok {
+		t.Fatal("listener should be valid for the channel it was issued for")
+	}
+
+	if _, ok := s.verifyListener("globex", id); ok {
+		t.Fatal("a token issued for acme must not validate for globex")
+	}
+}
+
+func TestSharedSecretListenerSurvivesDisconnect(t *testing.T) {
+	s := newTestServer()
+
+	id, err := s.newListenerID("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addListener("acme", id)
+	s.removeListener("acme", id)
+
+	if _, ok := s.verifyListener("acme", id); !ok {
+		t.Fatal("a valid token must still authorize after the listener map entry is purged on disconnect")
+	}
+}
+
+func TestNoneModeListenerSurvivesDisconnect(t *testing.T) {
+	s := newTestServer()
+	s.authMode = authModeNone
+
+	id, err := s.newListenerID("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addListener("acme", id)
+	s.removeListener("acme", id)
+
+	if _, ok := s.verifyListener("acme", id); !ok {
+		t.Fatal("authModeNone must not 401 a reconnect just because the listener map entry was purged on disconnect")
+	}
+}
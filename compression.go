@@ -0,0 +1,55 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseCompression maps the --compression flag to a gzip/flate compression
+// level. ok is false when compression should stay disabled entirely.
+func parseCompression(value string) (level int, ok bool, err error) {
+	switch value {
+	case "off":
+		return 0, false, nil
+	case "fast":
+		return gzip.BestSpeed, true, nil
+	case "default":
+		return gzip.DefaultCompression, true, nil
+	case "best":
+		return gzip.BestCompression, true, nil
+	default:
+		return 0, false, fmt.Errorf("unknown --compression %q, want off, fast, default or best", value)
+	}
+}
+
+// acceptsGzip reports whether the client's Accept-Encoding header allows a
+// gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(enc) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeGzipped writes body as a gzip-compressed response at level, setting
+// the headers that tell the client (and any caches) it's compressed. body
+// is always plain, uncompressed HTML, so there's no risk of compressing an
+// already-compressed payload here.
+func writeGzipped(w http.ResponseWriter, level int, body []byte) error {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.WriteHeader(http.StatusOK)
+
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	_, err = gz.Write(body)
+	return err
+}
@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bytes"
-	_ "embed"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,12 +17,11 @@ import (
 
 const (
 	msgBuffer = 1_000
-)
-
-var (
-	upgrader = websocket.Upgrader{}
-	//go:embed index.html
-	indexHtml []byte
+	// shutdownTimeout bounds how long http.Server.Shutdown waits for
+	// in-flight HTTP requests once a shutdown signal is received. Websocket
+	// listeners are hijacked connections, which Shutdown does not wait for;
+	// they are only told to stop by cancelling the server's context.
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
@@ -57,6 +53,35 @@ func main() {
 				Value:   8080,
 				EnvVars: []string{"PORT"},
 			},
+			&cli.StringSliceFlag{
+				Name:  "signing-secret",
+				Usage: "HMAC signing secret for a webhook provider, as `provider=secret` (repeatable, one per provider: github, gitlab, stripe)",
+			},
+			&cli.UintFlag{
+				Name:  "replay-size",
+				Usage: "number of past messages a reconnecting listener can replay via ?since=",
+				Value: 1_000,
+			},
+			&cli.StringFlag{
+				Name:    "bearer-token",
+				Usage:   "bearer token required for un-verified webhooks and the /channels admin endpoint",
+				EnvVars: []string{"BEARER_TOKEN"},
+			},
+			&cli.StringFlag{
+				Name:  "auth-mode",
+				Usage: "how listeners are bound to a channel: none or shared-secret (oidc is not implemented and is rejected)",
+				Value: string(authModeNone),
+			},
+			&cli.StringFlag{
+				Name:    "auth-secret",
+				Usage:   "HMAC secret used to sign listener cookies in --auth-mode=shared-secret",
+				EnvVars: []string{"AUTH_SECRET"},
+			},
+			&cli.StringFlag{
+				Name:  "compression",
+				Usage: "compress websocket messages and the index page: off, fast, default, best",
+				Value: "off",
+			},
 		},
 		Action: run(&log),
 	}
@@ -71,218 +96,71 @@ func run(log *zerolog.Logger) func(c *cli.Context) error {
 		log.Info().Msg("Starting the server")
 		log.Debug().Msg("Debug logging enabled")
 
-		s := &server{
-			log:      log,
-			messages: make(chan string, msgBuffer),
-			fanOut:   make(map[int64]chan string),
+		verifiers, err := parseVerifiers(c.StringSlice("signing-secret"))
+		if err != nil {
+			return err
 		}
 
-		return http.ListenAndServe(fmt.Sprintf(":%d", c.Uint("port")), s)
-	}
-}
-
-type server struct {
-	log      *zerolog.Logger
-	messages chan string
-	fanOut   map[int64]chan string
-	mu       sync.Mutex
-}
-
-func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.log.Info().Stringer("url", r.URL).Msg("Received a request")
-
-	go s.run()
-
-	switch r.URL.Path {
-	case "/":
-		s.serveIndex(w, r)
-	case "/logs":
-		s.logOutput(w, r)
-	case "/webhook":
-		s.webhookReceiver(w, r)
-	}
-}
-
-func (s *server) serveIndex(w http.ResponseWriter, r *http.Request) {
-	s.log.Info().Msg("Serving the index")
-	if r.Method != http.MethodGet {
-		s.log.Debug().Msg("Received a non-GET request")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	cookie, err := r.Cookie("idx")
-	if err == nil {
-		idx := parseCookie(cookie)
-		ch := s.getListener(idx)
-		if ch == nil {
-			err = http.ErrNoCookie
+		mode, err := parseAuthMode(c.String("auth-mode"))
+		if err != nil {
+			return err
 		}
-	}
-	if err != nil {
-		if errors.Is(err, http.ErrNoCookie) {
-			idx, _ := s.addListener()
-			s.log.Info().Int64("idx", idx).Msg("Setting cookie")
-			http.SetCookie(w, &http.Cookie{
-				Name:     "idx",
-				Value:    fmt.Sprint(idx),
-				HttpOnly: false,
-			})
-		} else {
-			s.log.Error().Err(err).Msg("Failed to get the cookie")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if mode == authModeSharedSecret && c.String("auth-secret") == "" {
+			return fmt.Errorf("--auth-mode=shared-secret requires --auth-secret")
 		}
-	}
-
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
-	w.Write(indexHtml)
-}
-
-func (s *server) webhookReceiver(w http.ResponseWriter, r *http.Request) {
-	s.log.Info().Msg("Received a webhook")
-	if r.Method != http.MethodPost {
-		s.log.Debug().Msg("Received a non-POST request")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	body := bytes.NewBufferString("")
-	if _, err := io.Copy(body, r.Body); err != nil {
-		s.log.Error().Err(err).Msg("Failed to copy the body")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	s.messages <- body.String()
-}
-
-func (s *server) logOutput(w http.ResponseWriter, r *http.Request) {
-	s.log.Info().Msg("Received a log output")
-	if r.Method != http.MethodGet {
-		s.log.Debug().Msg("Received a non-GET request")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	var idx int64
 
-	cookie, err := r.Cookie("idx")
-	if err == nil {
-		idx = parseCookie(cookie)
-		if idx == 0 {
-			err = http.ErrNoCookie
+		compressionLevel, compressionEnabled, err := parseCompression(c.String("compression"))
+		if err != nil {
+			return err
 		}
-	}
-	if err != nil {
-		if errors.Is(err, http.ErrNoCookie) {
-			s.log.Warn().Msg("Unauthorized")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		} else {
-			s.log.Error().Err(err).Msg("Failed to get the cookie")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	}
-
-	ch := s.getListener(idx)
-	if ch == nil {
-		s.log.Error().Err(err).Msg("Failed to get the listener")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		s.log.Error().Err(err).Msg("Failed to upgrade the connection")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
 
-	defer func() {
-		conn.Close()
-		s.removeListener(idx)
-	}()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
 
-	for msg := range ch {
-		if err := s.push(conn, msg); err != nil {
-			break
+		s := &server{
+			bearer:             c.String("bearer-token"),
+			authMode:           mode,
+			authSecret:         c.String("auth-secret"),
+			replaySize:         int(c.Uint("replay-size")),
+			compressionEnabled: compressionEnabled,
+			compressionLevel:   compressionLevel,
+			upgrader:           websocket.Upgrader{EnableCompression: compressionEnabled},
+			log:                log,
+			messages:           make(chan channelMessage, msgBuffer),
+			channels:           make(map[string]*ring),
+			listeners:          make(map[string]map[string]struct{}),
+			verifiers:          verifiers,
+			ctx:                ctx,
 		}
-	}
-}
+		go s.run()
 
-func (s *server) push(conn *websocket.Conn, msg string) error {
-	w, err := conn.NextWriter(websocket.TextMessage)
-	if err != nil {
-		s.log.Error().Err(err).Msg("Failed to get the writer")
-		return err
-	}
+		httpServer := &http.Server{
+			Addr:    fmt.Sprintf(":%d", c.Uint("port")),
+			Handler: s,
+		}
 
-	if _, err := io.Copy(w, strings.NewReader(msg)); err != nil {
-		s.log.Error().Err(err).Msg("Failed to copy the message")
-		return err
-	}
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
-	if err := w.Close(); err != nil {
-		s.log.Error().Err(err).Msg("Failed to close the writer")
-		return err
-	}
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- httpServer.ListenAndServe()
+		}()
 
-	return nil
-}
-
-func (s *server) run() {
-	for {
 		select {
-		case msg := <-s.messages:
-			s.mu.Lock()
-			for idx, ch := range s.fanOut {
-				s.log.Debug().Int64("idx", idx).Msg("Forwarding the message")
-				ch <- msg
+		case err := <-serveErr:
+			cancel()
+			return err
+		case <-sig:
+			log.Info().Msg("Shutting down, draining listeners")
+			cancel()
+
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer shutdownCancel()
+			if err := httpServer.Shutdown(shutdownCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				return err
 			}
-			s.mu.Unlock()
+			return nil
 		}
 	}
 }
-
-func (s *server) addListener() (int64, chan string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	idx := time.Now().UnixNano()
-	s.log.Info().Int64("idx", idx).Msg("Adding a listener")
-	ch := make(chan string, msgBuffer)
-	s.fanOut[idx] = ch
-	return idx, ch
-}
-
-func (s *server) getListener(idx int64) chan string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.log.Info().Int64("idx", idx).Msg("Getting listener")
-	return s.fanOut[idx]
-}
-
-func (s *server) removeListener(idx int64) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.log.Info().Int64("idx", idx).Msg("Removing a listener")
-	delete(s.fanOut, idx)
-}
-
-func parseCookie(cookie *http.Cookie) int64 {
-	if cookie == nil {
-		return 0
-	}
-
-	idx, err := strconv.ParseInt(cookie.Value, 10, 64)
-	if err != nil {
-		return 0
-	}
-
-	return idx
-}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Renderer turns a raw webhook payload into a structured, human-readable
+// message. The built-in renderers below cover GitHub, GitLab and
+// Alertmanager, falling back to a generic renderer for anything else. Users can
+// register their own by calling RegisterRenderer from an init() in an
+// additional file compiled into the binary.
+type Renderer interface {
+	// Detect reports whether this renderer knows how to handle the request
+	// that produced header/body.
+	Detect(header http.Header, body []byte) bool
+	// Render produces the event name and a short, one-line summary of the
+	// payload.
+	Render(header http.Header, body []byte) (event, summary string)
+}
+
+var renderers []Renderer
+
+// RegisterRenderer adds a Renderer to the front of the list consulted for
+// every incoming webhook, so the most recently registered renderer wins
+// ties over earlier, more generic ones.
+func RegisterRenderer(r Renderer) {
+	renderers = append([]Renderer{r}, renderers...)
+}
+
+func init() {
+	RegisterRenderer(alertmanagerRenderer{})
+	RegisterRenderer(gitlabRenderer{})
+	RegisterRenderer(githubRenderer{})
+}
+
+// renderEnvelope is the JSON shape emitted to listeners for every received
+// webhook; Provider is empty when the path named no provider.
+type renderEnvelope struct {
+	Provider   string      `json:"provider"`
+	Event      string      `json:"event"`
+	Summary    string      `json:"summary"`
+	Raw        string      `json:"raw"`
+	Headers    http.Header `json:"headers"`
+	ReceivedAt time.Time   `json:"received_at"`
+}
+
+// render picks the first registered Renderer that claims the request, or
+// genericJSONRenderer if none does, and uses it to build the envelope sent
+// to listeners. The generic fallback is kept out of the registered list so
+// that a renderer registered from any file's init() is still consulted.
+func render(provider string, header http.Header, body []byte) ([]byte, error) {
+	var event, summary string
+	matched := false
+	for _, r := range renderers {
+		if r.Detect(header, body) {
+			event, summary = r.Render(header, body)
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		event, summary = genericJSONRenderer{}.Render(header, body)
+	}
+
+	return json.Marshal(renderEnvelope{
+		Provider:   provider,
+		Event:      event,
+		Summary:    summary,
+		Raw:        string(body),
+		Headers:    header,
+		ReceivedAt: time.Now(),
+	})
+}
+
+// githubRenderer handles events dispatched by GitHub, identified by the
+// X-GitHub-Event header.
+type githubRenderer struct{}
+
+func (githubRenderer) Detect(header http.Header, _ []byte) bool {
+	return header.Get("X-GitHub-Event") != ""
+}
+
+func (githubRenderer) Render(header http.Header, body []byte) (event, summary string) {
+	event = header.Get("X-GitHub-Event")
+
+	var payload struct {
+		Ref        string `json:"ref"`
+		Commits    []any  `json:"commits"`
+		Action     string `json:"action"`
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+		PullRequest struct {
+			Title string `json:"title"`
+		} `json:"pull_request"`
+		Issue struct {
+			Title string `json:"title"`
+		} `json:"issue"`
+	}
+	_ = json.Unmarshal(body, &payload)
+
+	switch event {
+	case "push":
+		summary = fmt.Sprintf("push to %s on %s (%d commits)", payload.Ref, payload.Repository.FullName, len(payload.Commits))
+	case "pull_request":
+		summary = fmt.Sprintf("pull_request %s: %q on %s", payload.Action, payload.PullRequest.Title, payload.Repository.FullName)
+	case "issues":
+		summary = fmt.Sprintf("issue %s: %q on %s", payload.Action, payload.Issue.Title, payload.Repository.FullName)
+	default:
+		summary = fmt.Sprintf("%s event on %s", event, payload.Repository.FullName)
+	}
+
+	return event, summary
+}
+
+// gitlabRenderer handles events dispatched by GitLab, identified by the
+// X-Gitlab-Event header.
+type gitlabRenderer struct{}
+
+func (gitlabRenderer) Detect(header http.Header, _ []byte) bool {
+	return header.Get("X-Gitlab-Event") != ""
+}
+
+func (gitlabRenderer) Render(header http.Header, body []byte) (event, summary string) {
+	event = header.Get("X-Gitlab-Event")
+
+	var payload struct {
+		ObjectKind string `json:"object_kind"`
+		Ref        string `json:"ref"`
+		Project    struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+		} `json:"project"`
+		ObjectAttributes struct {
+			Title  string `json:"title"`
+			Action string `json:"action"`
+		} `json:"object_attributes"`
+	}
+	_ = json.Unmarshal(body, &payload)
+
+	switch payload.ObjectKind {
+	case "push":
+		summary = fmt.Sprintf("push to %s on %s", payload.Ref, payload.Project.PathWithNamespace)
+	case "merge_request":
+		summary = fmt.Sprintf("merge_request %s: %q on %s", payload.ObjectAttributes.Action, payload.ObjectAttributes.Title, payload.Project.PathWithNamespace)
+	default:
+		summary = fmt.Sprintf("%s event on %s", event, payload.Project.PathWithNamespace)
+	}
+
+	return event, summary
+}
+
+// alertmanagerRenderer handles Prometheus Alertmanager notifications, which
+// carry no distinguishing header but have a recognizable shape.
+type alertmanagerRenderer struct{}
+
+func (alertmanagerRenderer) Detect(_ http.Header, body []byte) bool {
+	var probe struct {
+		Receiver string `json:"receiver"`
+		Alerts   []any  `json:"alerts"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return false
+	}
+	return probe.Receiver != "" && probe.Alerts != nil
+}
+
+func (alertmanagerRenderer) Render(_ http.Header, body []byte) (event, summary string) {
+	var payload struct {
+		Status string `json:"status"`
+		Alerts []struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"alerts"`
+	}
+	_ = json.Unmarshal(body, &payload)
+
+	names := make([]string, 0, len(payload.Alerts))
+	for _, alert := range payload.Alerts {
+		if name, ok := alert.Labels["alertname"]; ok {
+			names = append(names, name)
+		}
+	}
+
+	return "alert", fmt.Sprintf("%s: %s (%d alerts)", payload.Status, strings.Join(names, ", "), len(payload.Alerts))
+}
+
+// genericJSONRenderer is the fallback for anything the other renderers
+// don't recognize. Its summary is the first line of the body, indented
+// first if the body is valid JSON (so a JSON object summarizes to "{…").
+// The envelope's raw field still carries the body as received; no
+// pretty-printed copy of it is sent.
+type genericJSONRenderer struct{}
+
+func (genericJSONRenderer) Detect(_ http.Header, _ []byte) bool { return true }
+
+func (genericJSONRenderer) Render(_ http.Header, body []byte) (event, summary string) {
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, body, "", "  ") == nil {
+		return "message", firstLine(pretty.String())
+	}
+	return "message", firstLine(string(body))
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + "…"
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package main
+
+import "sync"
+
+// ring is a fixed-size circular buffer of the most recently ingested
+// messages, each tagged with a monotonically increasing sequence number.
+// Listeners pull from the ring at their own cursor instead of being pushed
+// to over a per-listener channel, so a slow listener can no longer block
+// the broadcaster or other listeners.
+type ring struct {
+	mu                 sync.Mutex
+	entries            []string
+	oldestSeq, nextSeq int64
+	notify             chan struct{}
+}
+
+// minRingSize is the smallest ring newRing will allocate: a ring of size 0
+// can never retain a message, and seq%len(entries) would divide by zero on
+// the very first push.
+const minRingSize = 1
+
+func newRing(size int) *ring {
+	if size < minRingSize {
+		size = minRingSize
+	}
+	return &ring{
+		entries: make([]string, size),
+		notify:  make(chan struct{}),
+	}
+}
+
+// push appends msg to the ring under the next sequence number and wakes up
+// any listener waiting on a call to pull. It never blocks on a listener.
+func (r *ring) push(msg string) int64 {
+	r.mu.Lock()
+	seq := r.nextSeq
+	r.entries[seq%int64(len(r.entries))] = msg
+	r.nextSeq++
+	if r.nextSeq-r.oldestSeq > int64(len(r.entries)) {
+		r.oldestSeq = r.nextSeq - int64(len(r.entries))
+	}
+	notify := r.notify
+	r.notify = make(chan struct{})
+	r.mu.Unlock()
+
+	close(notify)
+	return seq
+}
+
+// latest returns the sequence number that will be assigned to the next
+// pushed message, i.e. the cursor a brand new listener should start from to
+// only see messages pushed after it connects.
+func (r *ring) latest() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nextSeq
+}
+
+// pull returns the message at cursor if one is already available. If the
+// ring hasn't reached cursor yet, ok is false and notify is a channel that
+// closes the next time push is called, so the caller can select on it
+// alongside its own cancellation. If cursor has fallen behind the oldest
+// entry still retained, pull fast-forwards to it and reports how many
+// messages were skipped.
+func (r *ring) pull(cursor int64) (msg string, next int64, skipped int64, notify chan struct{}, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if cursor >= r.nextSeq {
+		return "", cursor, 0, r.notify, false
+	}
+
+	if cursor < r.oldestSeq {
+		skipped = r.oldestSeq - cursor
+		cursor = r.oldestSeq
+	}
+
+	msg = r.entries[cursor%int64(len(r.entries))]
+	return msg, cursor + 1, skipped, nil, true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingPullReturnsPushedMessagesInOrder(t *testing.T) {
+	r := newRing(4)
+	r.push("one")
+	r.push("two")
+
+	msg, cursor, skipped, _, ok := r.pull(0)
+	if !ok || msg != "one" || skipped != 0 {
+		t.Fatalf("pull(0) = %q, %d, %v, %d; want one, 0, true, _", msg, skipped, ok, cursor)
+	}
+
+	msg, _, skipped, _, ok = r.pull(cursor)
+	if !ok || msg != "two" || skipped != 0 {
+		t.Fatalf("pull(1) = %q, %d, %v; want two, 0, true", msg, skipped, ok)
+	}
+}
+
+func TestRingPullBlocksUntilPush(t *testing.T) {
+	r := newRing(4)
+
+	_, _, _, notify, ok := r.pull(0)
+	if ok {
+		t.Fatalf("pull(0) on empty ring should not be ok")
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		<-notify
+		msg, _, _, _, ok := r.pull(0)
+		if !ok {
+			done <- ""
+			return
+		}
+		done <- msg
+	}()
+
+	r.push("hello")
+
+	select {
+	case msg := <-done:
+		if msg != "hello" {
+			t.Fatalf("got %q, want hello", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pull did not wake up after push")
+	}
+}
+
+func TestRingPullDetectsGapWhenCursorFallsBehind(t *testing.T) {
+	r := newRing(2)
+	r.push("one")
+	r.push("two")
+	r.push("three") // overwrites "one"
+
+	msg, _, skipped, _, ok := r.pull(0)
+	if !ok {
+		t.Fatal("pull(0) should still return the oldest retained entry")
+	}
+	if skipped != 1 {
+		t.Fatalf("skipped = %d, want 1", skipped)
+	}
+	if msg != "two" {
+		t.Fatalf("msg = %q, want two", msg)
+	}
+}
+
+func TestNewRingRejectsZeroSize(t *testing.T) {
+	r := newRing(0)
+	r.push("hello") // must not divide by zero
+
+	msg, _, _, _, ok := r.pull(0)
+	if !ok || msg != "hello" {
+		t.Fatalf("pull(0) = %q, %v; want hello, true", msg, ok)
+	}
+}
+
+func TestRingSlowConsumerDoesNotBlockPush(t *testing.T) {
+	r := newRing(2)
+
+	// A "slow" consumer just never calls pull. push must still return
+	// promptly for every other producer/consumer.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			r.push("msg")
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked on an idle listener")
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -16,42 +18,138 @@ import (
 	"github.com/rs/zerolog"
 )
 
-var (
-	upgrader = websocket.Upgrader{}
-	//go:embed index.html
-	indexHtml []byte
+const (
+	// writeWait is how long a single websocket write (a message or a ping)
+	// may take before the listener is considered dead.
+	writeWait = 10 * time.Second
+	// pongWait is how long we wait for a pong (or any other read) before
+	// considering the connection dead.
+	pongWait = 60 * time.Second
+	// pingPeriod must be less than pongWait so a ping always lands before
+	// the read deadline expires.
+	pingPeriod = (pongWait * 9) / 10
+	// sendBuffer is how many messages can queue up for a single listener
+	// before it is evicted for being too slow to keep up.
+	sendBuffer = 16
 )
 
-// server is an HTTP server that replies on three endpoints:
+//go:embed index.html
+var indexHtml []byte
+
+// server is an HTTP server that replies on four endpoints:
 //   - "/" where it serves a static html app that connects to the websocket
 //   - "/logs" where it serves the websocket
-//   - "/webhook" where it receives the webhooks from external services
+//   - "/webhook" (optionally suffixed with a channel and/or a provider, e.g.
+//     "/webhook/acme/github") where it receives the webhooks from external
+//     services
+//   - "/channels" a bearer-protected admin endpoint listing active channels
 //
-// All the browser clients connected to the websocket will receive the same
-// messages ingested on `/webhook`.
+// Listeners are scoped to a channel (defaulting to "default") and only
+// receive the messages ingested for that channel. In authModeNone any
+// listener can join any channel by guessing its name; authModeSharedSecret
+// binds a listener's cookie to a single channel with an HMAC signature so
+// it can't be forged or reused for another one.
 type server struct {
-	bearer   string
-	log      *zerolog.Logger
-	messages chan string
-	fanOut   map[int64]chan string
-	mu       sync.Mutex
+	bearer     string
+	authMode   authMode
+	authSecret string
+	replaySize int
+	// compressionEnabled turns on permessage-deflate for websocket
+	// connections and gzip for the index page; compressionLevel is the
+	// flate level (see parseCompression) used for both.
+	compressionEnabled bool
+	compressionLevel   int
+	upgrader           websocket.Upgrader
+	log                *zerolog.Logger
+	messages           chan channelMessage
+	mu                 sync.Mutex
+	channels           map[string]*ring
+	listeners          map[string]map[string]struct{}
+	verifiers          map[string]Verifier
+	// ctx is cancelled on graceful shutdown, so run() and every connected
+	// listener's pull loop stop promptly instead of blocking forever.
+	ctx context.Context
+}
+
+// channelMessage is a single ingested webhook body, tagged with the channel
+// it was received on.
+type channelMessage struct {
+	channel string
+	msg     string
+}
+
+// gapMarker is sent to a listener in place of the messages it missed once
+// it has fallen too far behind the replay buffer to catch up in full.
+type gapMarker struct {
+	Gap     bool  `json:"gap"`
+	Skipped int64 `json:"skipped"`
+	Seq     int64 `json:"seq"`
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.log.Info().Stringer("url", r.URL).Msg("Received a request")
 
-	go s.run()
-
-	switch r.URL.Path {
-	case "/":
+	switch {
+	case r.URL.Path == "/":
 		s.serveIndex(w, r)
-	case "/logs":
+	case r.URL.Path == "/logs":
 		s.logOutput(w, r)
-	case "/webhook":
+	case r.URL.Path == "/channels":
+		s.listChannels(w, r)
+	case strings.HasPrefix(r.URL.Path, "/webhook"):
 		s.webhookReceiver(w, r)
 	}
 }
 
+// authorizedBearer reports whether r carries the configured bearer token.
+// It always returns false if no bearer token is configured.
+func (s *server) authorizedBearer(r *http.Request) bool {
+	if s.bearer == "" {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	parts := strings.SplitN(auth, " ", 2)
+	return len(parts) == 2 && strings.ToLower(parts[0]) == "bearer" && parts[1] == s.bearer
+}
+
+// listChannels is a bearer-protected admin endpoint listing every channel
+// with at least one listener currently connected.
+func (s *server) listChannels(w http.ResponseWriter, r *http.Request) {
+	s.log.Info().Msg("Listing channels")
+	if r.Method != http.MethodGet {
+		s.log.Debug().Msg("Received a non-GET request")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.authorizedBearer(r) {
+		s.log.Debug().Msg("Received a request without a bearer token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	type channelInfo struct {
+		Channel   string `json:"channel"`
+		Listeners int    `json:"listeners"`
+	}
+
+	s.mu.Lock()
+	infos := make([]channelInfo, 0, len(s.listeners))
+	for channel, ls := range s.listeners {
+		if len(ls) == 0 {
+			continue
+		}
+		infos = append(infos, channelInfo{Channel: channel, Listeners: len(ls)})
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		s.log.Error().Err(err).Msg("Failed to encode the channel list")
+	}
+}
+
 func (s *server) serveIndex(w http.ResponseWriter, r *http.Request) {
 	s.log.Info().Msg("Serving the index")
 	if r.Method != http.MethodGet {
@@ -60,20 +158,26 @@ func (s *server) serveIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	channel := requestedChannel(r)
+
 	cookie, err := r.Cookie("idx")
 	if err == nil {
-		idx := parseCookie(cookie)
-		if ch := s.getListener(idx); ch == nil {
+		if _, ok := s.verifyListener(channel, cookie.Value); !ok {
 			err = http.ErrNoCookie
 		}
 	}
 	if err != nil {
 		if errors.Is(err, http.ErrNoCookie) {
-			idx, _ := s.addListener()
-			s.log.Info().Int64("idx", idx).Msg("Setting cookie")
+			id, err := s.newListenerID(channel)
+			if err != nil {
+				s.log.Error().Err(err).Msg("Failed to mint a listener token")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			s.log.Info().Str("channel", channel).Msg("Setting cookie")
 			http.SetCookie(w, &http.Cookie{
 				Name:     "idx",
-				Value:    fmt.Sprint(idx),
+				Value:    id,
 				HttpOnly: false,
 			})
 		} else {
@@ -83,9 +187,44 @@ func (s *server) serveIndex(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	page := indexWithChannel(channel)
+
 	w.Header().Set("Content-Type", "text/html")
+	if s.compressionEnabled && acceptsGzip(r) {
+		if err := writeGzipped(w, s.compressionLevel, page); err != nil {
+			s.log.Error().Err(err).Msg("Failed to gzip the index page")
+		}
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	w.Write(indexHtml)
+	w.Write(page)
+}
+
+// indexChannelPlaceholder is the quoted token index.html's inline script
+// assigns CHANNEL to; indexWithChannel substitutes it with the channel a
+// visitor's cookie is bound to, so the page's websocket reconnects into the
+// same channel it was served for instead of always falling back to
+// "default".
+const indexChannelPlaceholder = `"__CHANNEL__"`
+
+func indexWithChannel(channel string) []byte {
+	quoted := strconv.Quote(channel)
+	// The HTML tokenizer ends a script block at "</script" in any letter
+	// case, regardless of JS string escaping, so a channel name containing
+	// it could break out of the inline script. Escape every "</" so the
+	// browser never sees a closing tag while the JS string value is unchanged.
+	quoted = strings.ReplaceAll(quoted, "</", "<\\/")
+	return bytes.Replace(indexHtml, []byte(indexChannelPlaceholder), []byte(quoted), 1)
+}
+
+// requestedChannel returns the channel a request asked to join via its
+// "channel" query parameter, defaulting to "default".
+func requestedChannel(r *http.Request) string {
+	if channel := r.URL.Query().Get("channel"); channel != "" {
+		return channel
+	}
+	return "default"
 }
 
 func (s *server) webhookReceiver(w http.ResponseWriter, r *http.Request) {
@@ -96,24 +235,59 @@ func (s *server) webhookReceiver(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if s.bearer != "" {
-		auth := r.Header.Get("Authorization")
-		parts := strings.SplitN(auth, " ", 2)
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] != s.bearer {
-			s.log.Debug().Msg("Received a request without a bearer token")
+	channel, provider := parseWebhookPath(r.URL.Path, s.verifiers)
+
+	body := bytes.NewBufferString("")
+	if _, err := io.Copy(body, r.Body); err != nil {
+		s.log.Error().Err(err).Msg("Failed to copy the body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	raw := body.Bytes()
+
+	if v, ok := s.verifiers[provider]; ok {
+		if err := v.Verify(raw, r.Header); err != nil {
+			s.log.Warn().Err(err).Str("provider", provider).Msg("Rejected webhook with an invalid signature")
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+	} else if s.bearer != "" && !s.authorizedBearer(r) {
+		s.log.Debug().Msg("Received a request without a bearer token")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
 	}
 
-	body := bytes.NewBufferString("")
-	if _, err := io.Copy(body, r.Body); err != nil {
-		s.log.Error().Err(err).Msg("Failed to copy the body")
+	encoded, err := render(provider, r.Header, raw)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to render the webhook envelope")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	s.messages <- body.String()
+	s.messages <- channelMessage{channel: channel, msg: string(encoded)}
+}
+
+// parseWebhookPath interprets the path suffix after "/webhook". A single
+// segment that names a configured provider (e.g. "github") is treated as a
+// bare provider on the default channel, preserving the original
+// single-tenant "/webhook/<provider>" shape. Otherwise the first segment is
+// the channel and an optional second segment is the provider, e.g.
+// "/webhook/acme/github".
+func parseWebhookPath(path string, verifiers map[string]Verifier) (channel, provider string) {
+	trimmed := strings.Trim(strings.TrimPrefix(path, "/webhook"), "/")
+	if trimmed == "" {
+		return "default", ""
+	}
+
+	segments := strings.SplitN(trimmed, "/", 2)
+	if len(segments) == 1 {
+		if _, ok := verifiers[segments[0]]; ok {
+			return "default", segments[0]
+		}
+		return segments[0], ""
+	}
+
+	return segments[0], segments[1]
 }
 
 func (s *server) logOutput(w http.ResponseWriter, r *http.Request) {
@@ -124,49 +298,185 @@ func (s *server) logOutput(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var idx int64
+	channel := requestedChannel(r)
 
 	cookie, err := r.Cookie("idx")
-	if err == nil {
-		idx = parseCookie(cookie)
-		if idx == 0 {
-			err = http.ErrNoCookie
-		}
-	}
 	if err != nil {
-		if errors.Is(err, http.ErrNoCookie) {
-			s.log.Warn().Msg("Unauthorized")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		} else {
-			s.log.Error().Err(err).Msg("Failed to get the cookie")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		s.log.Warn().Msg("Unauthorized")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
 	}
 
-	ch := s.getListener(idx)
-	if ch == nil {
-		s.log.Error().Err(err).Msg("Failed to get the listener")
-		w.WriteHeader(http.StatusBadRequest)
+	id := cookie.Value
+	if _, ok := s.verifyListener(channel, id); !ok {
+		s.log.Warn().Str("channel", channel).Msg("Unauthorized")
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.log.Error().Err(err).Msg("Failed to upgrade the connection")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if s.compressionEnabled {
+		conn.EnableWriteCompression(true)
+		if err := conn.SetCompressionLevel(s.compressionLevel); err != nil {
+			s.log.Warn().Err(err).Msg("Failed to set the websocket compression level")
+		}
+	}
+
+	// listChannels counts listeners from this map, so it must only reflect
+	// actual live /logs connections, not every cookie ever minted by
+	// serveIndex.
+	s.addListener(channel, id)
+
+	connCtx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-connCtx.Done():
+		}
+	}()
+
 	defer func() {
 		conn.Close()
-		s.removeListener(idx)
+		s.removeListener(channel, id)
 	}()
 
-	for msg := range ch {
-		if err := s.push(conn, msg); err != nil {
-			break
+	send := make(chan string, sendBuffer)
+	go s.writePump(conn, send, cancel)
+	go s.readPump(conn, cancel)
+
+	buf := s.channelRing(channel)
+	cursor := buf.latest()
+	if since := r.URL.Query().Get("since"); since != "" {
+		if seq, err := strconv.ParseInt(since, 10, 64); err == nil {
+			cursor = seq + 1
+		} else {
+			s.log.Debug().Str("since", since).Msg("Ignoring malformed since query parameter")
+		}
+	}
+
+	defer close(send)
+
+	for {
+		msg, next, skipped, notify, ok := buf.pull(cursor)
+		if !ok {
+			select {
+			case <-notify:
+				continue
+			case <-connCtx.Done():
+				return
+			}
+		}
+		cursor = next
+		seq := next - 1
+
+		if skipped > 0 {
+			marker, err := json.Marshal(gapMarker{Gap: true, Skipped: skipped, Seq: seq})
+			if err != nil {
+				s.log.Error().Err(err).Msg("Failed to encode the gap marker")
+				return
+			}
+			if !s.enqueue(send, string(marker)) {
+				return
+			}
+		}
+
+		if !s.enqueue(send, withSeq(msg, seq)) {
+			return
+		}
+	}
+}
+
+// withSeq annotates an already-JSON-encoded message with the ring sequence
+// number it was delivered at, so a reconnecting listener can resume with
+// ?since=<seq> instead of replaying from the start. It leaves msg untouched
+// if it isn't a JSON object.
+func withSeq(msg string, seq int64) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(msg), &fields); err != nil {
+		return msg
+	}
+
+	seqJSON, err := json.Marshal(seq)
+	if err != nil {
+		return msg
+	}
+	fields["seq"] = seqJSON
+
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return msg
+	}
+	return string(out)
+}
+
+// enqueue hands msg to a listener's writePump without ever blocking: if its
+// send buffer is full the listener is too slow to keep up and is evicted
+// instead of stalling whoever is trying to forward it a message.
+func (s *server) enqueue(send chan<- string, msg string) bool {
+	select {
+	case send <- msg:
+		return true
+	default:
+		s.log.Warn().Msg("Evicting a listener that fell behind")
+		return false
+	}
+}
+
+// writePump owns the connection's write side: it relays messages from send
+// and keeps the connection alive with periodic pings, enforcing a write
+// deadline on every frame so a dead peer is detected instead of hanging
+// forever.
+func (s *server) writePump(conn *websocket.Conn, send <-chan string, cancel context.CancelFunc) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		cancel()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-send:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := s.push(conn, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readPump owns the connection's read side. It never expects application
+// messages from the browser, but it must keep reading so pong and close
+// frames are processed and the read deadline (refreshed on every pong) can
+// catch a dead peer.
+func (s *server) readPump(conn *websocket.Conn, cancel context.CancelFunc) {
+	defer cancel()
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
 		}
 	}
 }
@@ -194,53 +504,74 @@ func (s *server) push(conn *websocket.Conn, msg string) error {
 func (s *server) run() {
 	for {
 		select {
-		case msg := <-s.messages:
-			s.mu.Lock()
-			for idx, ch := range s.fanOut {
-				s.log.Debug().Int64("idx", idx).Msg("Forwarding the message")
-				ch <- msg
+		case cm, ok := <-s.messages:
+			if !ok {
+				return
 			}
-			s.mu.Unlock()
+			s.channelRing(cm.channel).push(cm.msg)
+		case <-s.ctx.Done():
+			return
 		}
 	}
 }
 
-func (s *server) addListener() (int64, chan string) {
+// channelRing returns the ring buffer for channel, creating it on first use.
+func (s *server) channelRing(channel string) *ring {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	idx := time.Now().UnixNano()
-	s.log.Info().Int64("idx", idx).Msg("Adding a listener")
-	ch := make(chan string, msgBuffer)
-	s.fanOut[idx] = ch
-	return idx, ch
+	r, ok := s.channels[channel]
+	if !ok {
+		r = newRing(s.replaySize)
+		s.channels[channel] = r
+	}
+	return r
 }
 
-func (s *server) getListener(idx int64) chan string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// newListenerID mints a fresh listener identity for channel: a signed,
+// channel-bound token in authModeSharedSecret, or a bare timestamp in
+// authModeNone, which performs no cryptographic binding at all.
+func (s *server) newListenerID(channel string) (string, error) {
+	if s.authMode == authModeSharedSecret {
+		return signToken(s.authSecret, channel)
+	}
+	return fmt.Sprint(time.Now().UnixNano()), nil
+}
 
-	s.log.Info().Int64("idx", idx).Msg("Getting listener")
-	return s.fanOut[idx]
+// verifyListener checks that id authorizes access to channel. In
+// authModeSharedSecret the signed token alone is authoritative. In
+// authModeNone there is no signature to check and no other binding either,
+// by design, so any id is accepted. Neither branch consults the listeners
+// map: that map tracks live /logs connections for listChannels, and a
+// listener that reconnects with the same cookie after logOutput's
+// removeListener purged it (e.g. a dropped websocket) must still be let
+// back in rather than permanently 401ing.
+func (s *server) verifyListener(channel, id string) (string, bool) {
+	if s.authMode == authModeSharedSecret {
+		boundChannel, err := verifyToken(s.authSecret, id)
+		if err != nil || boundChannel != channel {
+			return "", false
+		}
+	}
+
+	return channel, true
 }
 
-func (s *server) removeListener(idx int64) {
+func (s *server) addListener(channel, id string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.log.Info().Int64("idx", idx).Msg("Removing a listener")
-	delete(s.fanOut, idx)
-}
-
-func parseCookie(cookie *http.Cookie) int64 {
-	if cookie == nil {
-		return 0
+	s.log.Info().Str("channel", channel).Str("id", id).Msg("Adding a listener")
+	if s.listeners[channel] == nil {
+		s.listeners[channel] = make(map[string]struct{})
 	}
+	s.listeners[channel][id] = struct{}{}
+}
 
-	idx, err := strconv.ParseInt(cookie.Value, 10, 64)
-	if err != nil {
-		return 0
-	}
+func (s *server) removeListener(channel, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return idx
+	s.log.Info().Str("channel", channel).Str("id", id).Msg("Removing a listener")
+	delete(s.listeners[channel], id)
 }
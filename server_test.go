@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestWithSeqAnnotatesJSONMessage(t *testing.T) {
+	msg := withSeq(`{"summary":"hi"}`, 42)
+
+	var decoded struct {
+		Summary string `json:"summary"`
+		Seq     int64  `json:"seq"`
+	}
+	if err := json.Unmarshal([]byte(msg), &decoded); err != nil {
+		t.Fatalf("withSeq produced invalid JSON: %v", err)
+	}
+	if decoded.Summary != "hi" || decoded.Seq != 42 {
+		t.Fatalf("got %+v, want summary=hi seq=42", decoded)
+	}
+}
+
+func TestWithSeqLeavesNonJSONUntouched(t *testing.T) {
+	if msg := withSeq("plain text", 1); msg != "plain text" {
+		t.Fatalf("got %q, want unchanged", msg)
+	}
+}
+
+// TestWebhookReceiverRendersWithoutProviderSegment guards against
+// webhookReceiver only rendering when the request arrived on a
+// "/webhook/<provider>" path: a plain "/webhook" POST (e.g. Alertmanager,
+// which carries no distinguishing header) must still go through renderer
+// auto-detection instead of shipping the raw body.
+func TestWebhookReceiverRendersWithoutProviderSegment(t *testing.T) {
+	log := zerolog.New(io.Discard)
+	s := &server{
+		log:      &log,
+		messages: make(chan channelMessage, 1),
+	}
+
+	body := `{"receiver":"default","status":"firing","alerts":[{"labels":{"alertname":"HighLatency"}}]}`
+	r := httptest.NewRequest("POST", "/webhook", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	s.webhookReceiver(w, r)
+
+	select {
+	case cm := <-s.messages:
+		var envelope struct {
+			Event   string `json:"event"`
+			Summary string `json:"summary"`
+		}
+		if err := json.Unmarshal([]byte(cm.msg), &envelope); err != nil {
+			t.Fatalf("message wasn't a rendered envelope: %v (%q)", err, cm.msg)
+		}
+		if envelope.Event != "alert" {
+			t.Fatalf("event = %q, want alert", envelope.Event)
+		}
+		if !strings.Contains(envelope.Summary, "HighLatency") {
+			t.Fatalf("summary = %q, want it to mention HighLatency", envelope.Summary)
+		}
+	default:
+		t.Fatal("no message was enqueued")
+	}
+}
+
+func TestIndexWithChannelSubstitutesThePlaceholder(t *testing.T) {
+	page := indexWithChannel(`acme" </script><script>alert(1)</script>`)
+	if strings.Contains(string(page), "__CHANNEL__") {
+		t.Fatal("placeholder was not substituted")
+	}
+	// Only the page's own legitimate closing </script> tag may survive;
+	// anything from the channel name must be split so it can't break out
+	// of the inline script.
+	if n := strings.Count(string(page), "</script"); n != 1 {
+		t.Fatalf("found %d literal </script sequences, want 1 (the page's own)", n)
+	}
+}
+
+// TestServeIndexDoesNotRegisterAListener guards against listChannels
+// over-counting: visiting "/" mints a cookie but isn't itself a live /logs
+// connection, so it must not add an entry to the listeners map that
+// logOutput is responsible for tracking.
+func TestServeIndexDoesNotRegisterAListener(t *testing.T) {
+	log := zerolog.New(io.Discard)
+	s := &server{
+		authMode:  authModeNone,
+		log:       &log,
+		channels:  make(map[string]*ring),
+		listeners: make(map[string]map[string]struct{}),
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+
+	s.serveIndex(w, r)
+
+	if n := len(s.listeners["default"]); n != 0 {
+		t.Fatalf("listeners[default] has %d entries, want 0", n)
+	}
+}
+
+// BenchmarkBroadcastWithSlowListener demonstrates that one listener which
+// never drains its send channel no longer stalls delivery to the rest: the
+// benchmark's own "fast" listener keeps receiving at a steady rate
+// regardless of how many messages accumulate for the slow one.
+func BenchmarkBroadcastWithSlowListener(b *testing.B) {
+	log := zerolog.New(io.Discard)
+	s := &server{log: &log}
+
+	slow := make(chan string, sendBuffer) // never drained
+	fast := make(chan string, sendBuffer)
+	go func() {
+		for range fast {
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.enqueue(slow, "msg")
+		s.enqueue(fast, "msg")
+	}
+}